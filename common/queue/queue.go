@@ -0,0 +1,770 @@
+// Package queue implements a generic read-batch-and-ack task queue engine.
+//
+// It factors out the pattern shared by the transfer queue processor and the
+// timer processor (and any future replication/visibility processor): read
+// batches of tasks by a monotonically increasing id, dispatch them to a pool
+// of workers, track which ones have been acknowledged, and periodically
+// advance a persisted watermark once every preceding task has been
+// acknowledged. A Queue is configured with a Driver (how to read/complete
+// tasks against persistence) and a Handler (how to process one task), and
+// optionally partitioned into weighted priority groups so a noisy source of
+// tasks cannot starve the rest of the queue.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/uber-common/bark"
+
+	"code.uber.internal/devexp/minions/common/util"
+)
+
+// TaskID is the monotonically increasing sequence number tasks are read and
+// acknowledged by.
+type TaskID int64
+
+// Task is a unit of work read from a Driver and dispatched to a Handler.
+type Task interface {
+	GetTaskID() TaskID
+}
+
+// Driver abstracts the persistence layer a Queue reads tasks from and
+// reports completion/dead-lettering to.  Implementations wrap a concrete
+// persistence manager (e.g. persistence.ExecutionManager for the transfer
+// queue).
+type Driver interface {
+	// ReadTasks reads up to batchSize tasks for group with id in
+	// (minTaskID, maxTaskID].
+	ReadTasks(group string, minTaskID, maxTaskID TaskID, batchSize int) ([]Task, error)
+	// CompleteTask marks a single task as processed.
+	CompleteTask(id TaskID) error
+	// CompleteTaskWithDLQ moves a task to the dead-letter queue instead of
+	// completing it normally.
+	CompleteTaskWithDLQ(id TaskID, task Task, cause string) error
+	// ReadDLQTasks returns the tasks currently sitting in the dead-letter
+	// queue, for ReplayDLQ.
+	ReadDLQTasks() ([]Task, error)
+	// RemoveDLQTask deletes a task from the dead-letter queue once it has
+	// been successfully replayed, so ReplayDLQ does not keep reprocessing it
+	// forever.
+	RemoveDLQTask(id TaskID) error
+	// GetAckLevel returns the persisted ack level to seed new group readers
+	// from.
+	GetAckLevel() TaskID
+	// GetMaxReadLevel returns the highest TaskID known to have been
+	// generated so far, used as the upper bound of a read so the underlying
+	// store can stop scanning once it reaches a known tail.
+	GetMaxReadLevel() TaskID
+	// UpdateAckLevel persists the merged ack level across all groups.
+	UpdateAckLevel(level TaskID) error
+}
+
+// Handler processes a single task dispatched by a Queue.
+type Handler interface {
+	Handle(ctx context.Context, task Task) error
+	// IsRetryableError decides whether a Handle failure should be retried
+	// with backoff or failed fast to the DLQ.
+	IsRetryableError(err error) bool
+}
+
+// SchedulingMode selects how a Queue picks the next priority group to drain
+// a batch from.
+type SchedulingMode int
+
+const (
+	// StrictPriority drains the highest-weight group on nineteen polls in
+	// twenty and a uniformly random group on the twentieth, so a
+	// lower-priority group is never fully starved.  It does not check
+	// whether a group has tasks: a poll that picks an empty group reads
+	// nothing.
+	StrictPriority SchedulingMode = iota
+	// WeightedRoundRobin samples a group on every poll with probability
+	// proportional to its weight.
+	WeightedRoundRobin
+)
+
+// GroupConfig configures one priority group's relative scheduling weight.
+type GroupConfig struct {
+	Name   string
+	Weight int
+}
+
+// MetricsEmitter is the minimal metrics surface a Queue needs; implementing
+// it against whatever metrics client the caller already uses lets every
+// Queue (transfer, timer, ...) report uniformly labeled metrics.
+type MetricsEmitter interface {
+	IncCounter(name string, labels map[string]string)
+	RecordGauge(name string, labels map[string]string, value float64)
+}
+
+// Config configures a Queue.
+type Config struct {
+	// Name labels every metric this Queue emits, e.g. "transfer" or "timer".
+	Name string
+
+	WorkerCount             int
+	BatchSize               int
+	MinPollInterval         time.Duration
+	MaxPollInterval         time.Duration
+	UpdateAckInterval       time.Duration
+	TailSanityCheckInterval time.Duration
+
+	MaxRetries    int
+	MaxRetryDelay time.Duration
+
+	// Groups configures the priority groups to schedule across.  A nil or
+	// empty slice falls back to a single "default" group of weight 1.
+	Groups []GroupConfig
+	// GroupFn assigns a priority group name to a task.  Defaults to mapping
+	// every task to the first configured group.
+	GroupFn        func(task Task) string
+	SchedulingMode SchedulingMode
+
+	// ErrorHandler, if set, is invoked after every failed attempt to process
+	// a task, including panics recovered from a task worker.
+	ErrorHandler func(task Task, err error, retryCount int)
+	// BaseCtxFn supplies the context each task is processed under.  Defaults
+	// to context.Background.
+	BaseCtxFn func() context.Context
+
+	Metrics MetricsEmitter
+	Logger  bark.Logger
+}
+
+const (
+	defaultGroupName   = "default"
+	defaultRetryJitter = 100 * time.Millisecond
+)
+
+type (
+	// Queue drains tasks from a Driver across one or more weighted priority
+	// groups and dispatches them to a Handler, retrying transient failures
+	// with backoff and moving exhausted tasks to the dead-letter queue.
+	Queue struct {
+		driver  Driver
+		handler Handler
+		config  Config
+
+		groups       []*group
+		retryCounter *retryCounter
+		dlqCount     int64
+		panicCount   int64
+
+		isStarted  int32
+		isStopped  int32
+		shutdownWG sync.WaitGroup
+		shutdownCh chan struct{}
+	}
+
+	// group is one priority group's independent view of the queue: its own
+	// readLevel, outstanding tasks and ackLevel, so it can be drained in
+	// isolation without starving its peers.
+	group struct {
+		name             string
+		weight           int
+		lk               sync.RWMutex
+		outstandingTasks map[TaskID]bool
+		outstandingSince map[TaskID]time.Time
+		readLevel        TaskID
+		ackLevel         TaskID
+	}
+
+	groupedTask struct {
+		group *group
+		task  Task
+	}
+
+	retryCounter struct {
+		lk       sync.Mutex
+		attempts map[TaskID]int
+	}
+)
+
+// New constructs a Queue from a Driver, Handler and Config, filling in
+// defaults for any zero-valued fields.
+func New(driver Driver, handler Handler, config Config) *Queue {
+	if config.WorkerCount == 0 {
+		config.WorkerCount = 10
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = 10
+	}
+	if config.MinPollInterval == 0 {
+		config.MinPollInterval = 10 * time.Millisecond
+	}
+	if config.MaxPollInterval == 0 {
+		config.MaxPollInterval = 10 * time.Second
+	}
+	if config.UpdateAckInterval == 0 {
+		config.UpdateAckInterval = time.Second
+	}
+	if config.TailSanityCheckInterval == 0 {
+		config.TailSanityCheckInterval = time.Minute
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 10
+	}
+	if config.MaxRetryDelay == 0 {
+		config.MaxRetryDelay = 30 * time.Second
+	}
+	if len(config.Groups) == 0 {
+		config.Groups = []GroupConfig{{Name: defaultGroupName, Weight: 1}}
+	}
+	if config.GroupFn == nil {
+		defaultName := config.Groups[0].Name
+		config.GroupFn = func(task Task) string { return defaultName }
+	}
+	if config.BaseCtxFn == nil {
+		config.BaseCtxFn = context.Background
+	}
+
+	ackLevel := TaskID(driver.GetAckLevel())
+	groups := make([]*group, 0, len(config.Groups))
+	for _, gc := range config.Groups {
+		groups = append(groups, &group{
+			name:             gc.Name,
+			weight:           gc.Weight,
+			outstandingTasks: make(map[TaskID]bool),
+			outstandingSince: make(map[TaskID]time.Time),
+			readLevel:        ackLevel,
+			ackLevel:         ackLevel,
+		})
+	}
+
+	return &Queue{
+		driver:       driver,
+		handler:      handler,
+		config:       config,
+		groups:       groups,
+		retryCounter: newRetryCounter(),
+		shutdownCh:   make(chan struct{}),
+	}
+}
+
+// Start begins draining the queue in a background goroutine.
+func (q *Queue) Start() {
+	if !atomic.CompareAndSwapInt32(&q.isStarted, 0, 1) {
+		return
+	}
+
+	q.shutdownWG.Add(1)
+	go q.pump()
+
+	q.config.Logger.Infof("Queue '%v' started.", q.config.Name)
+}
+
+// Stop signals the background goroutine and its workers to shut down, and
+// waits (up to a minute) for them to drain.
+func (q *Queue) Stop() {
+	if !atomic.CompareAndSwapInt32(&q.isStopped, 0, 1) {
+		return
+	}
+
+	if atomic.LoadInt32(&q.isStarted) == 1 {
+		close(q.shutdownCh)
+	}
+
+	if success := util.AwaitWaitGroup(&q.shutdownWG, time.Minute); !success {
+		q.config.Logger.Warnf("Queue '%v' timed out on shutdown.", q.config.Name)
+	}
+
+	q.config.Logger.Infof("Queue '%v' stopped.", q.config.Name)
+}
+
+func (q *Queue) pump() {
+	defer q.shutdownWG.Done()
+	tasksCh := make(chan *groupedTask, q.config.BatchSize)
+
+	ctx, cancel := context.WithCancel(q.config.BaseCtxFn())
+	defer cancel()
+
+	var workerWG sync.WaitGroup
+	for i := 0; i < q.config.WorkerCount; i++ {
+		workerWG.Add(1)
+		go q.worker(ctx, tasksCh, &workerWG)
+	}
+
+	pollInterval := q.config.MinPollInterval
+	pollTimer := time.NewTimer(pollInterval)
+	defer pollTimer.Stop()
+	updateAckTimer := time.NewTimer(q.config.UpdateAckInterval)
+	defer updateAckTimer.Stop()
+	// tailSanityCheckTimer periodically re-reads the queue tail independent
+	// of the normal polling loop and with no upper bound, so the queue can
+	// recover if the in-memory max-read-level watermark was lost (e.g. due
+	// to a restart).
+	tailSanityCheckTimer := time.NewTicker(q.config.TailSanityCheckInterval)
+	defer tailSanityCheckTimer.Stop()
+	for {
+		select {
+		case <-q.shutdownCh:
+			q.config.Logger.Infof("Queue '%v' pump shutting down.", q.config.Name)
+			cancel()
+			// This is the only pump which writes to tasksCh, so it is safe to close channel here
+			close(tasksCh)
+			if success := util.AwaitWaitGroup(&workerWG, 10*time.Second); !success {
+				q.config.Logger.Warnf("Queue '%v' timed out on worker shutdown.", q.config.Name)
+			}
+			return
+		case <-pollTimer.C:
+			pollInterval = q.poll(tasksCh, pollInterval, q.driver.GetMaxReadLevel())
+			pollTimer = time.NewTimer(pollInterval)
+		case <-updateAckTimer.C:
+			q.updateAckLevel()
+			updateAckTimer = time.NewTimer(q.config.UpdateAckInterval)
+		case <-tailSanityCheckTimer.C:
+			q.poll(tasksCh, pollInterval, TaskID(math.MaxInt64))
+		}
+	}
+}
+
+func (q *Queue) poll(tasksCh chan<- *groupedTask, prevPollInterval time.Duration, maxTaskID TaskID) time.Duration {
+	g := q.pickGroup()
+	if g == nil {
+		return minDuration(2*prevPollInterval, q.config.MaxPollInterval)
+	}
+
+	tasks, err := q.readGroupTasks(g, maxTaskID)
+	if err != nil {
+		q.config.Logger.Warnf("Queue '%v' unable to retrieve tasks for group '%v': %v", q.config.Name, g.name, err)
+		return minDuration(2*prevPollInterval, q.config.MaxPollInterval)
+	}
+
+	if len(tasks) == 0 {
+		return minDuration(2*prevPollInterval, q.config.MaxPollInterval)
+	}
+
+	q.emitGauge("queue_length", g.name, float64(len(tasks)))
+	for _, tsk := range tasks {
+		q.emitCounter("queue_pushes_total", g.name)
+		tasksCh <- &groupedTask{group: g, task: tsk}
+	}
+
+	return q.config.MinPollInterval
+}
+
+func (q *Queue) readGroupTasks(g *group, maxTaskID TaskID) ([]Task, error) {
+	tasks, err := q.driver.ReadTasks(g.name, g.currentReadLevel(), maxTaskID, q.config.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tasks) == 0 {
+		return tasks, nil
+	}
+
+	g.lk.Lock()
+	for _, task := range tasks {
+		id := task.GetTaskID()
+		if g.readLevel >= id {
+			q.config.Logger.Fatalf("Next task ID is less than current read level for group '%v'.  TaskID: %v, ReadLevel: %v",
+				g.name, id, g.readLevel)
+		}
+		g.readLevel = id
+		g.outstandingTasks[id] = false
+		g.outstandingSince[id] = time.Now()
+	}
+	g.lk.Unlock()
+
+	return tasks, nil
+}
+
+func (g *group) currentReadLevel() TaskID {
+	g.lk.RLock()
+	defer g.lk.RUnlock()
+	return g.readLevel
+}
+
+// pickGroup selects the next priority group to drain a batch from, according
+// to q.config.SchedulingMode.
+func (q *Queue) pickGroup() *group {
+	groups := q.groups
+	if len(groups) == 0 {
+		return nil
+	}
+	if len(groups) == 1 {
+		return groups[0]
+	}
+
+	if q.config.SchedulingMode == StrictPriority {
+		// Steal one slot in twenty for a random group so a low-priority
+		// group is never fully starved by a busier one.
+		if rand.Intn(20) != 0 {
+			best := groups[0]
+			for _, g := range groups[1:] {
+				if g.weight > best.weight {
+					best = g
+				}
+			}
+			return best
+		}
+		return groups[rand.Intn(len(groups))]
+	}
+
+	total := 0
+	for _, g := range groups {
+		total += g.weight
+	}
+	if total <= 0 {
+		return groups[rand.Intn(len(groups))]
+	}
+	r := rand.Intn(total)
+	for _, g := range groups {
+		if r < g.weight {
+			return g
+		}
+		r -= g.weight
+	}
+	return groups[len(groups)-1]
+}
+
+// groupByName resolves the configured group for task via GroupFn, falling
+// back to the first configured group if the name is unrecognized.
+func (q *Queue) groupByName(task Task) *group {
+	name := q.config.GroupFn(task)
+	for _, g := range q.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return q.groups[0]
+}
+
+func (q *Queue) worker(ctx context.Context, tasksCh <-chan *groupedTask, workerWG *sync.WaitGroup) {
+	defer workerWG.Done()
+	for {
+		select {
+		case gt, ok := <-tasksCh:
+			if !ok {
+				return
+			}
+
+			q.processTask(ctx, gt.group, gt.task)
+		}
+	}
+}
+
+// processTask drives task through attemptTask until it reaches a terminal
+// outcome, and reports whether that outcome was a successful completion (as
+// opposed to being sent to the DLQ or abandoned on shutdown) so callers like
+// ReplayDLQ know whether the task can be considered resolved.
+func (q *Queue) processTask(ctx context.Context, g *group, task Task) (success bool) {
+	q.config.Logger.Debugf("Processing queue '%v' task: %v (group: %v)", q.config.Name, task.GetTaskID(), g.name)
+ProcessRetryLoop:
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		default:
+			if done, ok := q.attemptTask(ctx, g, task); done {
+				return ok
+			}
+			continue ProcessRetryLoop
+		}
+	}
+}
+
+// attemptTask executes a single attempt at processing task and reports
+// whether it reached a terminal outcome (completed, sent to the DLQ, or
+// failed with a non-retryable error) and, if so, whether that outcome was a
+// successful completion.  It recovers panics raised by Handle so a single bad
+// task degrades to a retryable failure instead of taking down the worker
+// goroutine and eventually the whole pump.
+func (q *Queue) attemptTask(ctx context.Context, g *group, task Task) (done, success bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&q.panicCount, 1)
+			err := fmt.Errorf("panic processing queue '%v' taskID %v: %v", q.config.Name, task.GetTaskID(), r)
+			q.config.Logger.Errorf("%v\n%s", err, debug.Stack())
+			done, success = q.handleTaskFailure(ctx, g, task, err, true)
+		}
+	}()
+
+	if err := q.handler.Handle(ctx, task); err != nil {
+		return q.handleTaskFailure(ctx, g, task, err, false)
+	}
+
+	q.retryCounter.clear(task.GetTaskID())
+	q.completeTask(g, task.GetTaskID())
+	return true, true
+}
+
+// handleTaskFailure records a failed attempt and either schedules a retry or
+// sends task to the DLQ.  A forceRetryable failure (a recovered panic) skips
+// the handler's IsRetryableError check and is always retried until
+// MaxRetries is reached.
+func (q *Queue) handleTaskFailure(ctx context.Context, g *group, task Task, err error,
+	forceRetryable bool) (done, success bool) {
+	attempt := q.retryCounter.increment(task.GetTaskID())
+	q.emitCounter("queue_retries_total", g.name)
+	if q.config.ErrorHandler != nil {
+		q.config.ErrorHandler(task, err, attempt)
+	}
+
+	if !forceRetryable && !q.handler.IsRetryableError(err) {
+		q.config.Logger.Errorf("Queue '%v' failed to process task with non-retryable error, sending to DLQ: %v",
+			q.config.Name, err)
+		q.sendToDLQ(g, task, err)
+		return true, false
+	}
+
+	if attempt >= q.config.MaxRetries {
+		q.config.Logger.Errorf("Queue '%v' exceeded max retries for taskID: %v, sending to DLQ: %v",
+			q.config.Name, task.GetTaskID(), err)
+		q.sendToDLQ(g, task, err)
+		return true, false
+	}
+
+	q.config.Logger.Warnf("Queue '%v' failed to process task: %v, will retry (attempt %v)", q.config.Name, err, attempt)
+
+	// Wait out the backoff selected against ctx.Done() rather than a bare
+	// time.Sleep, so a Stop() during a long retry delay (up to
+	// MaxRetryDelay) is observed immediately instead of blocking the worker
+	// until the sleep expires.
+	timer := time.NewTimer(retryDelay(attempt, q.config.MaxRetryDelay))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+	return false, false
+}
+
+func (q *Queue) sendToDLQ(g *group, task Task, cause error) {
+	if err := q.driver.CompleteTaskWithDLQ(task.GetTaskID(), task, cause.Error()); err != nil {
+		q.config.Logger.Errorf("Queue '%v' unable to move taskID %v to DLQ: %v", q.config.Name, task.GetTaskID(), err)
+		return
+	}
+
+	atomic.AddInt64(&q.dlqCount, 1)
+	q.emitCounter("queue_dlq_total", g.name)
+	q.retryCounter.clear(task.GetTaskID())
+	q.completeTask(g, task.GetTaskID())
+}
+
+func (q *Queue) completeTask(g *group, id TaskID) {
+	g.lk.Lock()
+	if _, ok := g.outstandingTasks[id]; ok {
+		g.outstandingTasks[id] = true
+	}
+	g.lk.Unlock()
+}
+
+// ReplayDLQ reprocesses every task currently sitting in the dead-letter queue
+// and removes from the DLQ each one that now succeeds.  The tasks are not put
+// back onto the queue's task channel: each one is processed in turn in the
+// calling goroutine (with the usual retries), so ReplayDLQ returns only once
+// every task has been handled.  It is intended to be called from an admin API
+// once the underlying cause (e.g. a downstream outage) has been resolved.
+func (q *Queue) ReplayDLQ() error {
+	tasks, err := q.driver.ReadDLQTasks()
+	if err != nil {
+		return err
+	}
+
+	ctx := q.config.BaseCtxFn()
+	for _, task := range tasks {
+		if !q.processTask(ctx, q.groupByName(task), task) {
+			// Processing failed again (sent back to the DLQ, or abandoned on
+			// shutdown): leave the original DLQ row in place so it is picked
+			// up by the next ReplayDLQ call.
+			continue
+		}
+
+		if err := q.driver.RemoveDLQTask(task.GetTaskID()); err != nil {
+			q.config.Logger.Warnf("Queue '%v' replayed taskID %v but failed to remove it from the DLQ: %v",
+				q.config.Name, task.GetTaskID(), err)
+		}
+	}
+
+	return nil
+}
+
+// updateAckLevel advances every priority group's local ack level and
+// persists the minimum across all of them via the Driver.  A merged
+// watermark is required because the underlying store only tracks a single
+// monotonically increasing ack level: advancing past a task in one group
+// while an older task is still outstanding in another would cause that task
+// to be skipped on failover.
+func (q *Queue) updateAckLevel() {
+	merged := TaskID(-1)
+	for _, g := range q.groups {
+		level := q.advanceGroupAckLevel(g)
+		if merged == -1 || level < merged {
+			merged = level
+		}
+	}
+
+	if merged == -1 {
+		return
+	}
+
+	if err := q.driver.UpdateAckLevel(merged); err != nil {
+		q.config.Logger.Warnf("Queue '%v' unable to update ack level: %v", q.config.Name, err)
+		return
+	}
+
+	q.emitGauge("queue_ack_lag_tasks", "", float64((q.driver.GetMaxReadLevel() - merged)))
+}
+
+// advanceGroupAckLevel walks g's outstanding tasks forward from its current
+// ack level, completing each acknowledged one in turn, and returns the new
+// ack level. The completion call itself (which, via the retryable
+// persistence clients, may block for several seconds retrying a transient
+// error) is made outside of g.lk so a slow completion doesn't stall
+// concurrent readGroupTasks/completeTask calls for the group -- only the
+// bookkeeping that decides the next candidate task ID is done under lock.
+func (q *Queue) advanceGroupAckLevel(g *group) TaskID {
+	g.lk.RLock()
+	current := g.ackLevel + 1
+	g.lk.RUnlock()
+
+MoveAckLevelLoop:
+	for {
+		g.lk.RLock()
+		readLevel := g.readLevel
+		acked, ok := g.outstandingTasks[current]
+		g.lk.RUnlock()
+
+		if current > readLevel {
+			break MoveAckLevelLoop
+		}
+		if !ok {
+			// No record of this task ID for this group (e.g. it belongs to a
+			// different group's slice of the shared ID space): skip over the
+			// gap rather than getting stuck on it.
+			current++
+			continue MoveAckLevelLoop
+		}
+		if !acked {
+			break MoveAckLevelLoop
+		}
+
+		if err := q.driver.CompleteTask(current); err != nil {
+			q.config.Logger.Warnf("Queue '%v' unable to complete task '%v': %v", q.config.Name, current, err)
+			break MoveAckLevelLoop
+		}
+
+		g.lk.Lock()
+		g.ackLevel = current
+		delete(g.outstandingTasks, current)
+		delete(g.outstandingSince, current)
+		g.lk.Unlock()
+		current++
+	}
+
+	g.lk.RLock()
+	defer g.lk.RUnlock()
+	return g.ackLevel
+}
+
+// OldestOutstandingTaskAge returns how long the oldest unacknowledged task
+// has been outstanding across all priority groups, for emitting as a metric.
+// It returns zero if there are no outstanding tasks.
+func (q *Queue) OldestOutstandingTaskAge() time.Duration {
+	var oldest time.Duration
+	for _, g := range q.groups {
+		g.lk.RLock()
+		var groupOldest time.Time
+		for _, since := range g.outstandingSince {
+			if groupOldest.IsZero() || since.Before(groupOldest) {
+				groupOldest = since
+			}
+		}
+		g.lk.RUnlock()
+
+		if groupOldest.IsZero() {
+			continue
+		}
+		if age := time.Since(groupOldest); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
+
+// DLQCount returns the number of tasks this Queue has moved to the
+// dead-letter queue since it was created.  Tasks removed from the DLQ by
+// ReplayDLQ are not subtracted, and tasks already in the DLQ when the Queue
+// was created are not counted.
+func (q *Queue) DLQCount() int64 {
+	return atomic.LoadInt64(&q.dlqCount)
+}
+
+// PanicCount returns the number of panics recovered from task workers.
+func (q *Queue) PanicCount() int64 {
+	return atomic.LoadInt64(&q.panicCount)
+}
+
+// RetryCount returns the total number of retry attempts currently recorded
+// across all outstanding tasks, for emitting as a metric.
+func (q *Queue) RetryCount() int64 {
+	return q.retryCounter.total()
+}
+
+func (q *Queue) emitCounter(name, group string) {
+	if q.config.Metrics == nil {
+		return
+	}
+	q.config.Metrics.IncCounter(name, map[string]string{"queue": q.config.Name, "group": group})
+}
+
+func (q *Queue) emitGauge(name, group string, value float64) {
+	if q.config.Metrics == nil {
+		return
+	}
+	q.config.Metrics.RecordGauge(name, map[string]string{"queue": q.config.Name, "group": group}, value)
+}
+
+func newRetryCounter() *retryCounter {
+	return &retryCounter{attempts: make(map[TaskID]int)}
+}
+
+func (r *retryCounter) increment(id TaskID) int {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	r.attempts[id]++
+	return r.attempts[id]
+}
+
+func (r *retryCounter) clear(id TaskID) {
+	r.lk.Lock()
+	delete(r.attempts, id)
+	r.lk.Unlock()
+}
+
+func (r *retryCounter) total() int64 {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	var total int64
+	for _, attempts := range r.attempts {
+		total += int64(attempts)
+	}
+	return total
+}
+
+// retryDelay computes the exponential backoff with jitter applied between
+// attempts of a single task, capped at maxDelay.
+func retryDelay(attempt int, maxDelay time.Duration) time.Duration {
+	const baseDelay = 100 * time.Millisecond
+	delay := baseDelay * time.Duration(1<<uint(attempt))
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(defaultRetryJitter)))
+	return delay + jitter
+}
+
+func minDuration(x, y time.Duration) time.Duration {
+	if x < y {
+		return x
+	}
+	return y
+}
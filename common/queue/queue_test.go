@@ -0,0 +1,241 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/uber-common/bark"
+)
+
+type fakeDriver struct {
+	dlqTasks       []Task
+	completed      []TaskID
+	dlqed          []TaskID
+	removedFromDLQ []TaskID
+	ackLevel       TaskID
+	maxReadLevel   TaskID
+}
+
+func (d *fakeDriver) ReadTasks(group string, minTaskID, maxTaskID TaskID, batchSize int) ([]Task, error) {
+	return nil, nil
+}
+
+func (d *fakeDriver) CompleteTask(id TaskID) error {
+	d.completed = append(d.completed, id)
+	return nil
+}
+
+func (d *fakeDriver) CompleteTaskWithDLQ(id TaskID, task Task, cause string) error {
+	d.dlqed = append(d.dlqed, id)
+	return nil
+}
+
+func (d *fakeDriver) ReadDLQTasks() ([]Task, error) {
+	return d.dlqTasks, nil
+}
+
+func (d *fakeDriver) RemoveDLQTask(id TaskID) error {
+	d.removedFromDLQ = append(d.removedFromDLQ, id)
+	return nil
+}
+
+func (d *fakeDriver) GetAckLevel() TaskID     { return d.ackLevel }
+func (d *fakeDriver) GetMaxReadLevel() TaskID { return d.maxReadLevel }
+func (d *fakeDriver) UpdateAckLevel(level TaskID) error {
+	d.ackLevel = level
+	return nil
+}
+
+type fakeTask struct{ id TaskID }
+
+func (t *fakeTask) GetTaskID() TaskID { return t.id }
+
+type fakeHandler struct {
+	err       error
+	retryable bool
+}
+
+func (h *fakeHandler) Handle(ctx context.Context, task Task) error { return h.err }
+func (h *fakeHandler) IsRetryableError(err error) bool             { return h.retryable }
+
+func newTestQueue(driver Driver, handler Handler) *Queue {
+	return New(driver, handler, Config{
+		Name:   "test",
+		Logger: bark.NewNopLogger(),
+	})
+}
+
+func TestQueueProcessTaskCompletesOnSuccess(t *testing.T) {
+	driver := &fakeDriver{maxReadLevel: 5}
+	q := newTestQueue(driver, &fakeHandler{})
+	g := q.groups[0]
+	g.outstandingTasks[1] = false
+	g.outstandingSince[1] = time.Now()
+	g.readLevel = 1
+
+	if !q.processTask(context.Background(), g, &fakeTask{id: 1}) {
+		t.Fatal("expected processTask to report success")
+	}
+
+	if level := q.advanceGroupAckLevel(g); level != 1 {
+		t.Fatalf("expected ack level 1, got %v", level)
+	}
+	if len(driver.completed) != 1 || driver.completed[0] != 1 {
+		t.Fatalf("expected task 1 to be completed, got %v", driver.completed)
+	}
+}
+
+func TestQueueSendsToDLQOnNonRetryableError(t *testing.T) {
+	driver := &fakeDriver{maxReadLevel: 5}
+	q := newTestQueue(driver, &fakeHandler{err: errors.New("boom"), retryable: false})
+	g := q.groups[0]
+	g.outstandingTasks[1] = false
+	g.readLevel = 1
+
+	if q.processTask(context.Background(), g, &fakeTask{id: 1}) {
+		t.Fatal("expected processTask to report failure for a task sent to the DLQ")
+	}
+	if len(driver.dlqed) != 1 || driver.dlqed[0] != 1 {
+		t.Fatalf("expected task 1 to be sent to the DLQ, got %v", driver.dlqed)
+	}
+	if q.DLQCount() != 1 {
+		t.Fatalf("expected DLQCount 1, got %v", q.DLQCount())
+	}
+}
+
+func TestQueueReplayDLQRemovesSuccessfullyReplayedTask(t *testing.T) {
+	driver := &fakeDriver{
+		maxReadLevel: 5,
+		dlqTasks:     []Task{&fakeTask{id: 1}},
+	}
+	q := newTestQueue(driver, &fakeHandler{})
+
+	if err := q.ReplayDLQ(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(driver.removedFromDLQ) != 1 || driver.removedFromDLQ[0] != 1 {
+		t.Fatalf("expected task 1 to be removed from the DLQ, got %v", driver.removedFromDLQ)
+	}
+}
+
+func TestQueueReplayDLQLeavesFailedTaskInDLQ(t *testing.T) {
+	driver := &fakeDriver{
+		maxReadLevel: 5,
+		dlqTasks:     []Task{&fakeTask{id: 1}},
+	}
+	q := newTestQueue(driver, &fakeHandler{err: errors.New("still broken"), retryable: false})
+
+	if err := q.ReplayDLQ(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(driver.removedFromDLQ) != 0 {
+		t.Fatalf("expected a task that failed replay to remain in the DLQ, got removed: %v", driver.removedFromDLQ)
+	}
+}
+
+func TestRetryCounter(t *testing.T) {
+	rc := newRetryCounter()
+	rc.increment(1)
+	rc.increment(1)
+	rc.increment(2)
+	if got := rc.total(); got != 3 {
+		t.Fatalf("expected total 3, got %v", got)
+	}
+	rc.clear(1)
+	if got := rc.total(); got != 1 {
+		t.Fatalf("expected total 1 after clearing taskID 1, got %v", got)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	maxDelay := 2 * time.Second
+	for attempt := 0; attempt < 10; attempt++ {
+		d := retryDelay(attempt, maxDelay)
+		if d < 0 || d > maxDelay+defaultRetryJitter {
+			t.Fatalf("attempt %v: delay %v out of expected bounds", attempt, d)
+		}
+	}
+}
+
+func newTestQueueWithGroups(handler Handler, groups []GroupConfig, mode SchedulingMode) *Queue {
+	return New(&fakeDriver{}, handler, Config{
+		Name:           "test",
+		Logger:         bark.NewNopLogger(),
+		Groups:         groups,
+		SchedulingMode: mode,
+	})
+}
+
+func TestPickGroupStrictPriorityPrefersHighestWeightGroup(t *testing.T) {
+	q := newTestQueueWithGroups(&fakeHandler{}, []GroupConfig{
+		{Name: "low", Weight: 1},
+		{Name: "high", Weight: 10},
+	}, StrictPriority)
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[q.pickGroup().name]++
+	}
+
+	if counts["high"] < 900 {
+		t.Fatalf("expected the high-weight group to dominate under StrictPriority, got counts: %v", counts)
+	}
+	if counts["low"] == 0 {
+		t.Fatal("expected the low-weight group to still be sampled occasionally so it is never fully starved")
+	}
+}
+
+func TestPickGroupWeightedRoundRobinDistributesByWeight(t *testing.T) {
+	q := newTestQueueWithGroups(&fakeHandler{}, []GroupConfig{
+		{Name: "a", Weight: 1},
+		{Name: "b", Weight: 3},
+	}, WeightedRoundRobin)
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		counts[q.pickGroup().name]++
+	}
+
+	ratio := float64(counts["b"]) / float64(counts["a"])
+	if ratio < 2 || ratio > 4.5 {
+		t.Fatalf("expected group 'b' to be picked roughly 3x as often as group 'a', got counts: %v (ratio %v)", counts, ratio)
+	}
+}
+
+type panicHandler struct{}
+
+func (h *panicHandler) Handle(ctx context.Context, task Task) error { panic("boom") }
+func (h *panicHandler) IsRetryableError(err error) bool             { return false }
+
+func TestAttemptTaskRecoversFromPanicAndSendsToDLQ(t *testing.T) {
+	driver := &fakeDriver{maxReadLevel: 5}
+	q := newTestQueue(driver, &panicHandler{})
+	// A recovered panic is retried regardless of IsRetryableError; with a
+	// budget of one attempt it is sent straight to the DLQ.
+	q.config.MaxRetries = 1
+	g := q.groups[0]
+	g.outstandingTasks[1] = false
+	g.readLevel = 1
+
+	done, success := q.attemptTask(context.Background(), g, &fakeTask{id: 1})
+	if !done || success {
+		t.Fatalf("expected a panic on the last allowed attempt to be a terminal failure, got done=%v success=%v", done, success)
+	}
+	if q.PanicCount() != 1 {
+		t.Fatalf("expected PanicCount 1, got %v", q.PanicCount())
+	}
+	if len(driver.dlqed) != 1 || driver.dlqed[0] != 1 {
+		t.Fatalf("expected the panicking task to be sent to the DLQ, got %v", driver.dlqed)
+	}
+}
+
+func TestMinDuration(t *testing.T) {
+	if got := minDuration(time.Second, 2*time.Second); got != time.Second {
+		t.Fatalf("expected 1s, got %v", got)
+	}
+	if got := minDuration(3*time.Second, 2*time.Second); got != 2*time.Second {
+		t.Fatalf("expected 2s, got %v", got)
+	}
+}
@@ -0,0 +1,132 @@
+package persistence
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	retryableClientMaxAttempts = 5
+	retryableClientBaseDelay   = 50 * time.Millisecond
+	retryableClientMaxDelay    = 5 * time.Second
+	retryableClientJitter      = 50 * time.Millisecond
+)
+
+// IsPersistenceTransientError classifies an error returned by an
+// ExecutionManager or TaskManager call as transient -- safe to retry with
+// backoff, e.g. a request timeout, a Cassandra "Unavailable", a dropped
+// connection, or a SQL deadlock -- or permanent, in which case it is
+// returned to the caller immediately.  ConditionFailedError and
+// EntityNotExistsError are the common permanent cases: retrying them can
+// never succeed since they reflect the actual state of the store rather
+// than a transient failure to reach it.
+func IsPersistenceTransientError(err error) bool {
+	switch err.(type) {
+	case *ConditionFailedError, *EntityNotExistsError:
+		return false
+	default:
+		return true
+	}
+}
+
+type retryableExecutionManager struct {
+	ExecutionManager
+}
+
+// NewExecutionPersistenceRetryableClient wraps an ExecutionManager so that
+// the transfer-task calls (GetTransferTasks, CompleteTransferTask,
+// CompleteTransferTaskWithDLQ, GetTransferTasksDLQ and
+// DeleteTransferTaskFromDLQ) are retried with exponential backoff when they
+// fail with a transient error (see IsPersistenceTransientError).
+// Non-transient errors such as ConditionFailedError and EntityNotExistsError
+// are returned immediately on the first attempt.  Every other
+// ExecutionManager method is passed straight through without retry.
+func NewExecutionPersistenceRetryableClient(manager ExecutionManager) ExecutionManager {
+	return &retryableExecutionManager{ExecutionManager: manager}
+}
+
+func (p *retryableExecutionManager) GetTransferTasks(request *GetTransferTasksRequest) (*GetTransferTasksResponse, error) {
+	var response *GetTransferTasksResponse
+	err := retryPersistenceOp(func() error {
+		var opErr error
+		response, opErr = p.ExecutionManager.GetTransferTasks(request)
+		return opErr
+	})
+	return response, err
+}
+
+func (p *retryableExecutionManager) CompleteTransferTask(request *CompleteTransferTaskRequest) error {
+	return retryPersistenceOp(func() error {
+		return p.ExecutionManager.CompleteTransferTask(request)
+	})
+}
+
+func (p *retryableExecutionManager) CompleteTransferTaskWithDLQ(request *CompleteTransferTaskWithDLQRequest) error {
+	return retryPersistenceOp(func() error {
+		return p.ExecutionManager.CompleteTransferTaskWithDLQ(request)
+	})
+}
+
+func (p *retryableExecutionManager) GetTransferTasksDLQ(
+	request *GetTransferTasksDLQRequest) (*GetTransferTasksDLQResponse, error) {
+	var response *GetTransferTasksDLQResponse
+	err := retryPersistenceOp(func() error {
+		var opErr error
+		response, opErr = p.ExecutionManager.GetTransferTasksDLQ(request)
+		return opErr
+	})
+	return response, err
+}
+
+func (p *retryableExecutionManager) DeleteTransferTaskFromDLQ(request *DeleteTransferTaskFromDLQRequest) error {
+	return retryPersistenceOp(func() error {
+		return p.ExecutionManager.DeleteTransferTaskFromDLQ(request)
+	})
+}
+
+type retryableTaskManager struct {
+	TaskManager
+}
+
+// NewTaskPersistenceRetryableClient wraps a TaskManager so that CreateTask is
+// retried with the same transient-error retry policy as
+// NewExecutionPersistenceRetryableClient.  Every other TaskManager method is
+// passed straight through without retry.
+func NewTaskPersistenceRetryableClient(manager TaskManager) TaskManager {
+	return &retryableTaskManager{TaskManager: manager}
+}
+
+func (p *retryableTaskManager) CreateTask(request *CreateTaskRequest) (*CreateTaskResponse, error) {
+	var response *CreateTaskResponse
+	err := retryPersistenceOp(func() error {
+		var opErr error
+		response, opErr = p.TaskManager.CreateTask(request)
+		return opErr
+	})
+	return response, err
+}
+
+// retryPersistenceOp retries op with exponential backoff and jitter while
+// its error satisfies IsPersistenceTransientError, giving up after
+// retryableClientMaxAttempts attempts and returning the last error seen.
+func retryPersistenceOp(op func() error) error {
+	var err error
+	for attempt := 0; attempt < retryableClientMaxAttempts; attempt++ {
+		err = op()
+		if err == nil || !IsPersistenceTransientError(err) {
+			return err
+		}
+
+		time.Sleep(retryableClientDelay(attempt))
+	}
+
+	return err
+}
+
+func retryableClientDelay(attempt int) time.Duration {
+	delay := retryableClientBaseDelay * time.Duration(1<<uint(attempt))
+	if delay > retryableClientMaxDelay {
+		delay = retryableClientMaxDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(retryableClientJitter)))
+}
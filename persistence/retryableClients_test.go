@@ -0,0 +1,94 @@
+package persistence
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestIsPersistenceTransientError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"generic error", errors.New("timeout"), true},
+		{"condition failed", &ConditionFailedError{}, false},
+		{"entity not exists", &EntityNotExistsError{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := IsPersistenceTransientError(test.err); got != test.transient {
+				t.Fatalf("IsPersistenceTransientError(%v) = %v, want %v", test.err, got, test.transient)
+			}
+		})
+	}
+}
+
+type fakeExecutionManager struct {
+	ExecutionManager
+	getTransferTasksAttempts int
+	getTransferTasksErrs     []error
+}
+
+func (m *fakeExecutionManager) GetTransferTasks(request *GetTransferTasksRequest) (*GetTransferTasksResponse, error) {
+	err := m.getTransferTasksErrs[m.getTransferTasksAttempts]
+	m.getTransferTasksAttempts++
+	if err != nil {
+		return nil, err
+	}
+	return &GetTransferTasksResponse{}, nil
+}
+
+func TestRetryableExecutionManagerRetriesTransientErrors(t *testing.T) {
+	manager := &fakeExecutionManager{
+		getTransferTasksErrs: []error{errors.New("unavailable"), errors.New("unavailable"), nil},
+	}
+	client := NewExecutionPersistenceRetryableClient(manager)
+
+	if _, err := client.GetTransferTasks(&GetTransferTasksRequest{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if manager.getTransferTasksAttempts != 3 {
+		t.Fatalf("expected 3 attempts, got %v", manager.getTransferTasksAttempts)
+	}
+}
+
+func TestRetryableExecutionManagerDoesNotRetryPermanentErrors(t *testing.T) {
+	manager := &fakeExecutionManager{
+		getTransferTasksErrs: []error{&EntityNotExistsError{}, nil, nil},
+	}
+	client := NewExecutionPersistenceRetryableClient(manager)
+
+	if _, err := client.GetTransferTasks(&GetTransferTasksRequest{}); err == nil {
+		t.Fatal("expected the permanent error to be returned")
+	}
+	if manager.getTransferTasksAttempts != 1 {
+		t.Fatalf("expected exactly 1 attempt for a non-transient error, got %v", manager.getTransferTasksAttempts)
+	}
+}
+
+func TestRetryableExecutionManagerGivesUpAfterMaxAttempts(t *testing.T) {
+	errs := make([]error, retryableClientMaxAttempts)
+	for i := range errs {
+		errs[i] = errors.New("unavailable")
+	}
+	manager := &fakeExecutionManager{getTransferTasksErrs: errs}
+	client := NewExecutionPersistenceRetryableClient(manager)
+
+	if _, err := client.GetTransferTasks(&GetTransferTasksRequest{}); err == nil {
+		t.Fatal("expected an error after exhausting all retries")
+	}
+	if manager.getTransferTasksAttempts != retryableClientMaxAttempts {
+		t.Fatalf("expected %v attempts, got %v", retryableClientMaxAttempts, manager.getTransferTasksAttempts)
+	}
+}
+
+func TestRetryableClientDelayCapsAtMaxDelay(t *testing.T) {
+	for attempt := 0; attempt < 20; attempt++ {
+		d := retryableClientDelay(attempt)
+		if d > retryableClientMaxDelay+retryableClientJitter {
+			t.Fatalf("attempt %v: delay %v exceeds max %v plus jitter", attempt, d, retryableClientMaxDelay)
+		}
+	}
+}
@@ -1,8 +1,7 @@
 package workflow
 
 import (
-	"sync"
-	"sync/atomic"
+	"context"
 	"time"
 
 	"github.com/pborman/uuid"
@@ -10,287 +9,293 @@ import (
 
 	workflow "code.uber.internal/devexp/minions/.gen/go/shared"
 	"code.uber.internal/devexp/minions/common"
-	"code.uber.internal/devexp/minions/common/util"
+	"code.uber.internal/devexp/minions/common/queue"
 	"code.uber.internal/devexp/minions/persistence"
 )
 
-const (
-	transferTaskBatchSize              = 10
-	transferProcessorMinPollInterval   = 10 * time.Millisecond
-	transferProcessorMaxPollInterval   = 10 * time.Second
-	transferProcessorUpdateAckInterval = time.Second
-	taskWorkerCount                    = 10
-)
+// transferQueueProcessorImpl is a thin adapter wiring the generic
+// common/queue engine up to the transfer task persistence APIs: a
+// transferDriver to read/complete/DLQ transfer tasks against the shard, and a
+// transferHandler to dispatch them to matching via the task manager.
+type transferQueueProcessorImpl struct {
+	queue *queue.Queue
+}
 
-type (
-	transferQueueProcessorImpl struct {
-		ackMgr           *ackManager
-		executionManager persistence.ExecutionManager
-		taskManager      persistence.TaskManager
-		isStarted        int32
-		isStopped        int32
-		shutdownWG       sync.WaitGroup
-		shutdownCh       chan struct{}
-		logger           bark.Logger
-	}
+const defaultTransferGroupName = "default"
+
+// TransferQueueProcessorConfig exposes the common/queue knobs relevant to the
+// transfer queue processor: priority groups and how to classify a task into
+// one, scheduling mode, retry policy, and hooks for error handling,
+// cancellation and metrics. Every field's zero value falls back to the same
+// default queue.New itself would pick (IsRetryableError falls back to
+// defaultIsRetryableTransferError), so a zero-value config runs a single
+// "default" group under queue.New's default retry policy: exponential
+// backoff between attempts, then the DLQ once MaxRetries is reached.
+type TransferQueueProcessorConfig struct {
+	Groups  []queue.GroupConfig
+	GroupFn func(task *persistence.TaskInfo) string
+
+	SchedulingMode queue.SchedulingMode
+	MaxRetries     int
+	MaxRetryDelay  time.Duration
+
+	ErrorHandler func(task *persistence.TaskInfo, err error, retryCount int)
+	BaseCtxFn    func() context.Context
+
+	// IsRetryableError decides whether a Handle failure should be retried
+	// with backoff or failed fast to the DLQ. Defaults to treating
+	// *workflow.EntityNotExistsError as the only non-retryable case.
+	IsRetryableError func(err error) bool
+
+	Metrics queue.MetricsEmitter
+}
 
-	// ackManager is created by transferQueueProcessor to keep track of the transfer queue ackLevel for the shard.
-	// It keeps track of read level when dispatching transfer tasks to processor and maintains a map of outstanding tasks.
-	// Outstanding tasks map uses the task id sequencer as the key, which is used by updateAckLevel to move the ack level
-	// for the shard when all preceding tasks are acknowledged.
-	ackManager struct {
-		shard            ShardContext
-		executionMgr     persistence.ExecutionManager
-		logger           bark.Logger
-		lk               sync.RWMutex
-		outstandingTasks map[int64]bool
-		readLevel        int64
-		ackLevel         int64
+// defaultIsRetryableTransferError treats entity-not-found as a permanent
+// failure since retrying will never succeed; everything else is assumed to
+// be a transient downstream issue (e.g. matching being unavailable).
+// Transient persistence errors are already retried by the retryable
+// execution/task manager clients before they ever reach here, so in
+// practice this only needs to catch genuinely permanent failures from the
+// matching-side CreateTask call.
+func defaultIsRetryableTransferError(err error) bool {
+	switch err.(type) {
+	case *workflow.EntityNotExistsError:
+		return false
+	default:
+		return true
 	}
+}
 
-	taskInfoWithLevel struct {
-		readLevel int64
-		taskInfo  *persistence.TaskInfo
+func newTransferQueueProcessor(shard ShardContext, executionManager persistence.ExecutionManager,
+	taskManager persistence.TaskManager, logger bark.Logger, config TransferQueueProcessorConfig) transferQueueProcessor {
+	// Wrap the managers with transient-error retry before handing them to
+	// the driver/handler, so a brief Cassandra blip is absorbed here instead
+	// of burning through the queue-level retry/DLQ budget.
+	executionManager = persistence.NewExecutionPersistenceRetryableClient(executionManager)
+	taskManager = persistence.NewTaskPersistenceRetryableClient(taskManager)
+
+	groupFn := config.GroupFn
+	if groupFn == nil {
+		groupFn = func(task *persistence.TaskInfo) string { return defaultTransferGroupName }
+	}
+	groups := config.Groups
+	if len(groups) == 0 {
+		groups = []queue.GroupConfig{{Name: defaultTransferGroupName, Weight: 1}}
+	}
+	isRetryableError := config.IsRetryableError
+	if isRetryableError == nil {
+		isRetryableError = defaultIsRetryableTransferError
 	}
-)
 
-func newTransferQueueProcessor(shard ShardContext, executionManager persistence.ExecutionManager,
-	taskManager persistence.TaskManager, logger bark.Logger) transferQueueProcessor {
+	driver := &transferDriver{shard: shard, executionManager: executionManager, groupFn: groupFn}
+	handler := &transferHandler{taskManager: taskManager, isRetryableError: isRetryableError}
+
 	return &transferQueueProcessorImpl{
-		ackMgr:           newAckManager(shard, executionManager, logger),
-		executionManager: executionManager,
-		taskManager:      taskManager,
-		shutdownCh:       make(chan struct{}),
-		logger:           logger,
+		queue: queue.New(driver, handler, queue.Config{
+			Name:           "transfer",
+			Groups:         groups,
+			GroupFn:        func(task queue.Task) string { return groupFn(task.(*transferTask).info) },
+			SchedulingMode: config.SchedulingMode,
+			MaxRetries:     config.MaxRetries,
+			MaxRetryDelay:  config.MaxRetryDelay,
+			ErrorHandler:   adaptTransferErrorHandler(config.ErrorHandler),
+			BaseCtxFn:      config.BaseCtxFn,
+			Metrics:        config.Metrics,
+			Logger:         logger,
+		}),
 	}
 }
 
-func newAckManager(shard ShardContext, executionMgr persistence.ExecutionManager, logger bark.Logger) *ackManager {
-	ackLevel := shard.GetTransferAckLevel()
-	return &ackManager{
-		shard:            shard,
-		executionMgr:     executionMgr,
-		outstandingTasks: make(map[int64]bool),
-		readLevel:        ackLevel,
-		ackLevel:         ackLevel,
-		logger:           logger,
+// adaptTransferErrorHandler adapts a TransferQueueProcessorConfig.ErrorHandler
+// (expressed in terms of *persistence.TaskInfo) into the queue.Task-typed
+// hook queue.Config.ErrorHandler expects, passing nil through unchanged.
+func adaptTransferErrorHandler(fn func(task *persistence.TaskInfo, err error, retryCount int)) func(queue.Task, error, int) {
+	if fn == nil {
+		return nil
+	}
+	return func(task queue.Task, err error, retryCount int) {
+		fn(task.(*transferTask).info, err, retryCount)
 	}
 }
 
 func (t *transferQueueProcessorImpl) Start() {
-	if !atomic.CompareAndSwapInt32(&t.isStarted, 0, 1) {
-		return
-	}
-
-	t.shutdownWG.Add(1)
-	go t.processorPump()
-
-	t.logger.Info("Transfer queue processor started.")
+	t.queue.Start()
 }
 
 func (t *transferQueueProcessorImpl) Stop() {
-	if !atomic.CompareAndSwapInt32(&t.isStopped, 0, 1) {
-		return
-	}
-
-	if atomic.LoadInt32(&t.isStarted) == 1 {
-		close(t.shutdownCh)
-	}
-
-	if success := util.AwaitWaitGroup(&t.shutdownWG, time.Minute); !success {
-		t.logger.Warn("Transfer queue processor timed out on shutdown.")
-	}
-
-	t.logger.Info("Transfer queue processor stopped.")
+	t.queue.Stop()
 }
 
-func (t *transferQueueProcessorImpl) processorPump() {
-	defer t.shutdownWG.Done()
-	tasksCh := make(chan *persistence.TaskInfo, transferTaskBatchSize)
-
-	var workerWG sync.WaitGroup
-	for i := 0; i < taskWorkerCount; i++ {
-		workerWG.Add(1)
-		go t.taskWorker(tasksCh, &workerWG)
-	}
+// ReplayDLQ reprocesses every task currently sitting in the transfer task
+// dead-letter queue in the calling goroutine, removing from the DLQ each one
+// that now succeeds (see queue.Queue.ReplayDLQ).  It is intended to be called
+// from an admin API once the underlying cause (e.g. a matching outage) has
+// been resolved.
+func (t *transferQueueProcessorImpl) ReplayDLQ() error {
+	return t.queue.ReplayDLQ()
+}
 
-	pollInterval := transferProcessorMinPollInterval
-	pollTimer := time.NewTimer(pollInterval)
-	defer pollTimer.Stop()
-	updateAckTimer := time.NewTimer(transferProcessorUpdateAckInterval)
-	defer updateAckTimer.Stop()
-	for {
-		select {
-		case <-t.shutdownCh:
-			t.logger.Info("Transfer queue processor pump shutting down.")
-			// This is the only pump which writes to tasksCh, so it is safe to close channel here
-			close(tasksCh)
-			if success := util.AwaitWaitGroup(&workerWG, 10*time.Second); !success {
-				t.logger.Warn("Transfer queue processor timed out on worker shutdown.")
-			}
-			return
-		case <-pollTimer.C:
-			pollInterval = t.processTransferTasks(tasksCh, pollInterval)
-			pollTimer = time.NewTimer(pollInterval)
-		case <-updateAckTimer.C:
-			t.ackMgr.updateAckLevel()
-		}
-	}
+// DLQCount returns the number of transfer tasks this processor has moved to
+// the dead-letter queue since it was created, for emitting as a metric.
+func (t *transferQueueProcessorImpl) DLQCount() int64 {
+	return t.queue.DLQCount()
 }
 
-func (t *transferQueueProcessorImpl) processTransferTasks(tasksCh chan<- *persistence.TaskInfo,
-	prevPollInterval time.Duration) time.Duration {
-	tasks, err := t.ackMgr.readTransferTasks()
+// PanicCount returns the number of panics recovered from task workers, for
+// emitting as a metric.
+func (t *transferQueueProcessorImpl) PanicCount() int64 {
+	return t.queue.PanicCount()
+}
 
-	if err != nil {
-		t.logger.Warnf("Processor unable to retrieve transfer tasks: %v", err)
-		return minDuration(2*prevPollInterval, transferProcessorMaxPollInterval)
-	}
+// OldestOutstandingTaskAge returns how long the oldest unacknowledged
+// transfer task has been outstanding, for emitting as a metric.
+func (t *transferQueueProcessorImpl) OldestOutstandingTaskAge() time.Duration {
+	return t.queue.OldestOutstandingTaskAge()
+}
 
-	if len(tasks) == 0 {
-		return minDuration(2*prevPollInterval, transferProcessorMaxPollInterval)
-	}
+// RetryCount returns the total number of retry attempts currently recorded
+// across all outstanding transfer tasks, for emitting as a metric.
+func (t *transferQueueProcessorImpl) RetryCount() int64 {
+	return t.queue.RetryCount()
+}
 
-	for _, tsk := range tasks {
-		tasksCh <- tsk
-	}
+// transferTask adapts a *persistence.TaskInfo to queue.Task.
+type transferTask struct {
+	info *persistence.TaskInfo
+}
 
-	return transferProcessorMinPollInterval
+func (t *transferTask) GetTaskID() queue.TaskID {
+	return queue.TaskID(t.info.TaskID)
 }
 
-func (t *transferQueueProcessorImpl) taskWorker(tasksCh <-chan *persistence.TaskInfo, workerWG *sync.WaitGroup) {
-	defer workerWG.Done()
-	for {
-		select {
-		case task, ok := <-tasksCh:
-			if !ok {
-				return
-			}
+// transferDriver implements queue.Driver against persistence.ExecutionManager,
+// reading and acknowledging transfer tasks for a single shard.
+type transferDriver struct {
+	shard            ShardContext
+	executionManager persistence.ExecutionManager
+	// groupFn classifies a task into its priority group. It must be kept in
+	// sync with the queue.Config.GroupFn built from the same function in
+	// newTransferQueueProcessor, since it is how ReadTasks filters the
+	// shared ID-keyed task stream down to the group being read for.
+	groupFn func(task *persistence.TaskInfo) string
+}
 
-			t.processTransferTask(task)
-		}
+func (d *transferDriver) ReadTasks(group string, minTaskID, maxTaskID queue.TaskID,
+	batchSize int) ([]queue.Task, error) {
+	response, err := d.executionManager.GetTransferTasks(&persistence.GetTransferTasksRequest{
+		MinTaskID: int64(minTaskID),
+		MaxTaskID: int64(maxTaskID),
+		BatchSize: batchSize,
+		RangeID:   d.shard.GetRangeID(),
+	})
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (t *transferQueueProcessorImpl) processTransferTask(task *persistence.TaskInfo) {
-	t.logger.Debugf("Processing transfer task: %v", task.TaskID)
-ProcessRetryLoop:
-	for retryCount := 0; retryCount < 10; retryCount++ {
-		select {
-		case <-t.shutdownCh:
-			return
-		default:
-			var transferTask persistence.Task
-			switch task.TaskType {
-			case persistence.TaskTypeActivity:
-				transferTask = &persistence.ActivityTask{TaskList: task.TaskList, ScheduleID: task.ScheduleID,
-					TaskID: task.TaskID}
-			case persistence.TaskTypeDecision:
-				transferTask = &persistence.DecisionTask{TaskList: task.TaskList, ScheduleID: task.ScheduleID,
-					TaskID: task.TaskID}
-			}
-			execution := workflow.WorkflowExecution{WorkflowId: common.StringPtr(task.WorkflowID),
-				RunId: common.StringPtr(task.RunID)}
-
-			_, err1 := t.taskManager.CreateTask(&persistence.CreateTaskRequest{
-				Execution: execution,
-				TaskList:  task.TaskList,
-				Data:      transferTask,
-			})
-
-			if err1 != nil {
-				t.logger.Warnf("Processor failed to create task: %v", err1)
-				time.Sleep(100 * time.Millisecond)
-				continue ProcessRetryLoop
-			}
-
-			t.ackMgr.completeTask(task.TaskID)
-			return
+	// Transfer tasks are keyed purely by a shard-global monotonic TaskID --
+	// persistence.GetTransferTasksRequest has no notion of priority group --
+	// so the store cannot filter a read down to one group's tasks for us.
+	// Apply the same classification used to assign tasks to groups
+	// client-side instead, keeping only the ones that belong to the group
+	// being read for. Note this means a group whose tasks are consistently
+	// outnumbered within a single batch by a busier group's can see its read
+	// level stall until the busier group's tasks are completed and age out
+	// of the store; true per-group isolation would require the store itself
+	// to partition by group.
+	tasks := make([]queue.Task, 0, len(response.Tasks))
+	for _, info := range response.Tasks {
+		if d.groupFn(info) != group {
+			continue
 		}
+		tasks = append(tasks, &transferTask{info: info})
 	}
+	return tasks, nil
+}
 
-	// All attempts to process transfer task failed.  We won't be able to move the ackLevel so panic
-	t.logger.Fatalf("Retry count exceeded for transfer taskID: %v", task.TaskID)
+func (d *transferDriver) CompleteTask(id queue.TaskID) error {
+	return d.executionManager.CompleteTransferTask(&persistence.CompleteTransferTaskRequest{
+		Execution: workflow.WorkflowExecution{
+			WorkflowId: common.StringPtr(uuid.New()),
+			RunId:      common.StringPtr(uuid.New()),
+		},
+		TaskID: int64(id),
+	})
 }
 
-func (a *ackManager) readTransferTasks() ([]*persistence.TaskInfo, error) {
-	response, err := a.executionMgr.GetTransferTasks(&persistence.GetTransferTasksRequest{
-		ReadLevel: atomic.LoadInt64(&a.readLevel),
-		BatchSize: transferTaskBatchSize,
-		RangeID:   a.shard.GetRangeID(),
+func (d *transferDriver) CompleteTaskWithDLQ(id queue.TaskID, task queue.Task, cause string) error {
+	return d.executionManager.CompleteTransferTaskWithDLQ(&persistence.CompleteTransferTaskWithDLQRequest{
+		TaskID: int64(id),
+		Task:   task.(*transferTask).info,
+		Cause:  cause,
 	})
+}
 
+func (d *transferDriver) ReadDLQTasks() ([]queue.Task, error) {
+	response, err := d.executionManager.GetTransferTasksDLQ(&persistence.GetTransferTasksDLQRequest{})
 	if err != nil {
 		return nil, err
 	}
 
-	tasks := response.Tasks
-	if len(tasks) == 0 {
-		return tasks, nil
+	tasks := make([]queue.Task, 0, len(response.Tasks))
+	for _, info := range response.Tasks {
+		tasks = append(tasks, &transferTask{info: info})
 	}
+	return tasks, nil
+}
 
-	a.lk.Lock()
-	for _, task := range tasks {
-		if a.readLevel >= task.TaskID {
-			a.logger.Fatalf("Next task ID is less than current read level.  TaskID: %v, ReadLevel: %v", task.TaskID,
-				a.readLevel)
-		}
-		a.logger.Debugf("Moving read level: %v", task.TaskID)
-		a.readLevel = task.TaskID
-		a.outstandingTasks[a.readLevel] = false
-	}
-	a.lk.Unlock()
+func (d *transferDriver) RemoveDLQTask(id queue.TaskID) error {
+	return d.executionManager.DeleteTransferTaskFromDLQ(&persistence.DeleteTransferTaskFromDLQRequest{
+		TaskID: int64(id),
+	})
+}
 
-	return tasks, nil
+func (d *transferDriver) GetAckLevel() queue.TaskID {
+	return queue.TaskID(d.shard.GetTransferAckLevel())
 }
 
-func (a *ackManager) completeTask(taskID int64) {
-	a.lk.RLock()
-	if _, ok := a.outstandingTasks[taskID]; ok {
-		a.outstandingTasks[taskID] = true
-	}
-	a.lk.RUnlock()
+func (d *transferDriver) GetMaxReadLevel() queue.TaskID {
+	return queue.TaskID(d.shard.GetMaxTransferTaskID())
 }
 
-func (a *ackManager) updateAckLevel() {
-	updatedAckLevel := int64(-1)
-	a.lk.Lock()
-MoveAckLevelLoop:
-	for current := a.ackLevel + 1; current <= a.readLevel; current++ {
-		if acked, ok := a.outstandingTasks[current]; ok {
-			if acked {
-				err := a.executionMgr.CompleteTransferTask(&persistence.CompleteTransferTaskRequest{
-					Execution: workflow.WorkflowExecution{
-						WorkflowId: common.StringPtr(uuid.New()),
-						RunId:      common.StringPtr(uuid.New()),
-					},
-					TaskID: current,
-				})
-
-				if err != nil {
-					a.logger.Warnf("Processor unable to complete transfer task '%v': %v", current, err)
-					break MoveAckLevelLoop
-				}
-				a.logger.Debugf("Updating ack level: %v", current)
-				a.ackLevel = current
-				updatedAckLevel = current
-				delete(a.outstandingTasks, current)
-			} else {
-				break MoveAckLevelLoop
-			}
-		}
-	}
-	a.lk.Unlock()
+func (d *transferDriver) UpdateAckLevel(level queue.TaskID) error {
+	d.shard.UpdateAckLevel(int64(level))
+	return nil
+}
 
-	if updatedAckLevel != -1 {
-		a.shard.UpdateAckLevel(updatedAckLevel)
-	}
+// transferHandler implements queue.Handler, dispatching a transfer task to
+// matching by creating the corresponding task-list entry via the task
+// manager.
+type transferHandler struct {
+	taskManager      persistence.TaskManager
+	isRetryableError func(err error) bool
 }
 
-func minDuration(x, y time.Duration) time.Duration {
-	if x < y {
-		return x
+func (h *transferHandler) Handle(ctx context.Context, t queue.Task) error {
+	task := t.(*transferTask).info
+
+	var taskData persistence.Task
+	switch task.TaskType {
+	case persistence.TaskTypeActivity:
+		taskData = &persistence.ActivityTask{TaskList: task.TaskList, ScheduleID: task.ScheduleID,
+			TaskID: task.TaskID}
+	case persistence.TaskTypeDecision:
+		taskData = &persistence.DecisionTask{TaskList: task.TaskList, ScheduleID: task.ScheduleID,
+			TaskID: task.TaskID}
 	}
+	execution := workflow.WorkflowExecution{WorkflowId: common.StringPtr(task.WorkflowID),
+		RunId: common.StringPtr(task.RunID)}
+
+	_, err := h.taskManager.CreateTask(&persistence.CreateTaskRequest{
+		Execution: execution,
+		TaskList:  task.TaskList,
+		Data:      taskData,
+	})
+	return err
+}
 
-	return y
+// IsRetryableError delegates to the configurable hook set up in
+// TransferQueueProcessorConfig.IsRetryableError (defaultIsRetryableTransferError
+// unless the caller overrides it).
+func (h *transferHandler) IsRetryableError(err error) bool {
+	return h.isRetryableError(err)
 }